@@ -20,7 +20,6 @@ under the License.
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -28,12 +27,16 @@ import (
 	"strings"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
 )
 
 // SimpleChaincode example simple Chaincode implementation
 type SimpleChaincode struct {
 }
 
+// colorNameIndex is the composite-key namespace of the color~name secondary index
+const colorNameIndex = "color~name"
+
 type Marble struct {
 	ObjectType string `json:"docType"` //docType is used to distinguish the various types of objects in state database
 	Name       string `json:"name"`    //the fieldtags are needed to keep case from bouncing around
@@ -42,6 +45,50 @@ type Marble struct {
 	Owner      string `json:"owner"`
 }
 
+type MarbleHistoryEntry struct {
+	TxId      string `json:"txId"`
+	Timestamp int64  `json:"timestamp"`
+	IsDelete  bool   `json:"isDelete"`
+	Value     Marble `json:"value"`
+}
+
+// MarblePrivateDetails holds the fields that are kept off the channel and out
+// of the ordering service, in the collectionMarblePrivateDetails collection.
+type MarblePrivateDetails struct {
+	Name  string `json:"name"`
+	Price int    `json:"price"`
+}
+
+// marbleTransientInput is the shape expected under the "marble" key of the transient map
+type marbleTransientInput struct {
+	Name  string `json:"name"`
+	Color string `json:"color"`
+	Size  int    `json:"size"`
+	Owner string `json:"owner"`
+}
+
+// marblePrivateTransientInput is the shape expected under the "marble_owner_private" key of the transient map
+type marblePrivateTransientInput struct {
+	Name  string `json:"name"`
+	Price int    `json:"price"`
+}
+
+// ownerQuerySelector marshals to the CouchDB Mango selector used by queryMarblesByOwner, e.g.
+// {"selector":{"docType":"Marble","owner":"tom"}}
+type ownerQuerySelector struct {
+	Selector struct {
+		DocType string `json:"docType"`
+		Owner   string `json:"owner"`
+	} `json:"selector"`
+}
+
+// PaginatedQueryResponse wraps a page of marbles along with the bookmark needed to fetch the next page
+type PaginatedQueryResponse struct {
+	Records             []Marble `json:"records"`
+	FetchedRecordsCount int32    `json:"fetchedRecordsCount"`
+	Bookmark            string   `json:"bookmark"`
+}
+
 // ============================================================================================================================
 // Main
 // ============================================================================================================================
@@ -95,6 +142,22 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) ([]byte, erro
 	} else if function == "set_owner" { //change owner of a marble
 		res, err := t.set_owner(stub, args)
 		return res, err
+	} else if function == "queryMarbles" { //find marbles matching a rich query selector
+		return t.queryMarbles(stub, args)
+	} else if function == "queryMarblesByOwner" { //find marbles owned by a given owner
+		return t.queryMarblesByOwner(stub, args)
+	} else if function == "get_marble_history" { //get the history of a marble
+		return t.get_marble_history(stub, args)
+	} else if function == "init_marble_private" { //create a new marble with a private price, via transient data
+		return t.init_marble_private(stub, args)
+	} else if function == "read_marble_private" { //get the public fields of a private marble
+		return t.read_marble_private(stub, args)
+	} else if function == "read_marble_price" { //get the private price of a marble
+		return t.read_marble_price(stub, args)
+	} else if function == "transfer_marbles_by_color" { //bulk-transfer all marbles of a color to a new owner
+		return t.transfer_marbles_by_color(stub, args)
+	} else if function == "delete_marble" { //delete a marble and its derived keys
+		return t.delete_marble(stub, args)
 	}
 	fmt.Println("invoke did not find func: " + function) //error
 
@@ -177,7 +240,8 @@ func (t *SimpleChaincode) init_marble_table(stub shim.ChaincodeStubInterface, ar
 }
 
 // ============================================================================================================================
-// Init Marble - create a new marble, store into chaincode state as a JSON record
+// Init Marble - create a new marble, store into chaincode state as a JSON record.
+// For marbles whose price should stay off the channel, see init_marble_private instead.
 // ============================================================================================================================
 func (t *SimpleChaincode) init_marble_json(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 
@@ -197,16 +261,142 @@ func (t *SimpleChaincode) init_marble_json(stub shim.ChaincodeStubInterface, arg
 	marble := &Marble{objectType, name, color, size, owner}
 
 	// Convert marble to JSON with Color and Name as compound key
-	compoundKey, _ := t.createCompoundKey(objectType, []string{marble.Color, marble.Name})
+	compoundKey, _ := t.createCompoundKey(stub, objectType, []string{marble.Color, marble.Name})
 	marbleJSONBytes, _ := json.Marshal(marble)
 
 	// Add marble JSON to state
 	stub.PutState(compoundKey, marbleJSONBytes)
 
+	// Maintain a color~name secondary index so marbles can be looked up and range-queried by color,
+	// e.g. by transfer_marbles_by_color. Only the composite key matters; the stored value is a single null byte.
+	colorNameIndexKey, err := stub.CreateCompositeKey(colorNameIndex, []string{marble.Color, marble.Name})
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutState(colorNameIndexKey, []byte{0x00})
+	if err != nil {
+		return nil, err
+	}
+
 	fmt.Println("- end init marble")
 	return nil, nil
 }
 
+// ============================================================================================================================
+// Init Marble Private - create a new marble, keeping the price out of the public Marbles collection.
+// Arguments are read from the transient map so they never land in the proposal, the transaction, or
+// the ordering service: "marble" holds the public fields, "marble_owner_private" holds the price.
+// ============================================================================================================================
+func (t *SimpleChaincode) init_marble_private(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	transientMap, err := stub.GetTransient()
+	if err != nil {
+		return nil, fmt.Errorf("Error getting transient: %s", err)
+	}
+
+	marbleJSONBytes, ok := transientMap["marble"]
+	if !ok {
+		return nil, errors.New("marble must be a key in the transient map")
+	}
+
+	var marbleInput marbleTransientInput
+	err = json.Unmarshal(marbleJSONBytes, &marbleInput)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode JSON of: %s", string(marbleJSONBytes))
+	}
+
+	privateJSONBytes, ok := transientMap["marble_owner_private"]
+	if !ok {
+		return nil, errors.New("marble_owner_private must be a key in the transient map")
+	}
+
+	var privateInput marblePrivateTransientInput
+	err = json.Unmarshal(privateJSONBytes, &privateInput)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode JSON of: %s", string(privateJSONBytes))
+	}
+
+	objectType := "Marble"
+	marble := &Marble{objectType, marbleInput.Name, strings.ToLower(marbleInput.Color), marbleInput.Size, strings.ToLower(marbleInput.Owner)}
+	compoundKey, _ := t.createCompoundKey(stub, objectType, []string{marble.Color, marble.Name})
+
+	marbleBytes, err := json.Marshal(marble)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutPrivateData("collectionMarbles", compoundKey, marbleBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	privateDetails := &MarblePrivateDetails{marbleInput.Name, privateInput.Price}
+	privateDetailsBytes, err := json.Marshal(privateDetails)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutPrivateData("collectionMarblePrivateDetails", compoundKey, privateDetailsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end init marble private")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// read marble private - get the public fields of a marble from the collectionMarbles private collection
+// ============================================================================================================================
+func (t *SimpleChaincode) read_marble_private(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0       1
+	// "name", "blue"
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting name and color")
+	}
+
+	objectType := "Marble"
+	name := args[0]
+	color := strings.ToLower(args[1])
+	compoundKey, _ := t.createCompoundKey(stub, objectType, []string{color, name})
+
+	marbleBytes, err := stub.GetPrivateData("collectionMarbles", compoundKey)
+	if err != nil {
+		return nil, err
+	}
+	if marbleBytes == nil {
+		return nil, errors.New("Private marble does not exist: " + compoundKey)
+	}
+
+	return marbleBytes, nil
+}
+
+// ============================================================================================================================
+// read marble price - get the price of a marble from the collectionMarblePrivateDetails private collection
+// ============================================================================================================================
+func (t *SimpleChaincode) read_marble_price(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0       1
+	// "name", "blue"
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting name and color")
+	}
+
+	objectType := "Marble"
+	name := args[0]
+	color := strings.ToLower(args[1])
+	compoundKey, _ := t.createCompoundKey(stub, objectType, []string{color, name})
+
+	priceBytes, err := stub.GetPrivateData("collectionMarblePrivateDetails", compoundKey)
+	if err != nil {
+		return nil, err
+	}
+	if priceBytes == nil {
+		return nil, errors.New("Marble price does not exist: " + compoundKey)
+	}
+
+	return priceBytes, nil
+}
+
 // ============================================================================================================================
 // get marble from table
 // ============================================================================================================================
@@ -245,7 +435,7 @@ func (t *SimpleChaincode) get_marble_json(stub shim.ChaincodeStubInterface, args
 	objectType := "Marble"
 	name := args[0]
 	color := args[1]
-	compoundKey, _ := t.createCompoundKey(objectType, []string{color, name})
+	compoundKey, _ := t.createCompoundKey(stub, objectType, []string{color, name})
 
 	marbleJSONBytes, _ := stub.GetState(compoundKey)
 
@@ -301,20 +491,34 @@ func (t *SimpleChaincode) get_blue_marbles_table(stub shim.ChaincodeStubInterfac
 // ============================================================================================================================
 func (t *SimpleChaincode) get_blue_marbles_json(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 
+	//    0           1
+	// "pageSize", "bookmark"  (both optional)
+
 	// Define partial key to query within Marbles namespace (objectType)
 	objectType := "Marble"
 	partialKeysForQuery := []string{"blue"} // First N of the compound keys can be chosen
 
-	// Query state using partial keys
-	keysIter, _ := t.partialCompoundKeyQuery(stub, objectType, partialKeysForQuery)
+	pageSize, bookmark, err := parsePaginationArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	// Query state using partial keys, capped to a page at a time
+	keysIter, responseMetadata, err := stub.GetStateByPartialCompositeKeyWithPagination(objectType, partialKeysForQuery, pageSize, bookmark)
+	if err != nil {
+		return nil, err
+	}
 	defer keysIter.Close()
 
 	// Get records from result set
 	var marbles []Marble
 	for keysIter.HasNext() {
-		_, marbleJSONBytes, _ := keysIter.Next()
+		keyValue, err := keysIter.Next()
+		if err != nil {
+			return nil, err
+		}
 		marble := Marble{}
-		json.Unmarshal(marbleJSONBytes, &marble)
+		json.Unmarshal(keyValue.Value, &marble)
 		marbles = append(marbles, marble)
 	}
 
@@ -323,38 +527,171 @@ func (t *SimpleChaincode) get_blue_marbles_json(stub shim.ChaincodeStubInterface
 		fmt.Println("blue marble: " + marble.Name)
 	}
 
-	return nil, nil
+	return marshalPaginatedResponse(marbles, responseMetadata)
 }
 
 // ============================================================================================================================
-// Utility functions (may become chaincode APIs)
+// get marble history - walk the change history of a marble's compound key
 // ============================================================================================================================
+func (t *SimpleChaincode) get_marble_history(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0       1
+	// "name", "blue"
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting name and color")
+	}
+
+	objectType := "Marble"
+	name := args[0]
+	color := strings.ToLower(args[1])
+	compoundKey, _ := t.createCompoundKey(stub, objectType, []string{color, name})
+
+	resultsIterator, err := stub.GetHistoryForKey(compoundKey)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var history []MarbleHistoryEntry
+	for resultsIterator.HasNext() {
+		historyData, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
 
-func (t *SimpleChaincode) createCompoundKey(objectType string, keys []string) (string, error) {
-	var keyBuffer bytes.Buffer
-	keyBuffer.WriteString(objectType)
-	for _, key := range keys {
-		keyBuffer.WriteString(strconv.Itoa(len(key)))
-		keyBuffer.WriteString(key)
+		marble := Marble{}
+		if !historyData.IsDelete {
+			json.Unmarshal(historyData.Value, &marble)
+		}
+
+		history = append(history, MarbleHistoryEntry{
+			TxId:      historyData.TxId,
+			Timestamp: historyData.Timestamp.Seconds,
+			IsDelete:  historyData.IsDelete,
+			Value:     marble,
+		})
+	}
+
+	historyJSONBytes, err := json.Marshal(history)
+	if err != nil {
+		return nil, err
 	}
-	return keyBuffer.String(), nil
+
+	fmt.Println("- end get_marble_history")
+	return historyJSONBytes, nil
 }
 
-func (t *SimpleChaincode) partialCompoundKeyQuery(stub shim.ChaincodeStubInterface, objectType string, keys []string) (shim.StateRangeQueryIteratorInterface, error) {
-	// TODO - call RangeQueryState() based on the partial keys and pass back the iterator
+// ============================================================================================================================
+// queryMarblesByOwner - rich query for all marbles owned by a given owner
+// ============================================================================================================================
+func (t *SimpleChaincode) queryMarblesByOwner(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0       1           2
+	// "bob", "pageSize", "bookmark"  (pageSize and bookmark are optional)
+	if len(args) < 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting owner name")
+	}
+
+	owner := strings.ToLower(args[0])
 
-	keyString, _ := t.createCompoundKey(objectType, keys)
-	keysIter, err := stub.RangeQueryState(keyString+"1", keyString+":")
+	selector := ownerQuerySelector{}
+	selector.Selector.DocType = "Marble"
+	selector.Selector.Owner = owner
+
+	queryStringBytes, err := json.Marshal(selector)
 	if err != nil {
-		return nil, fmt.Errorf("Error fetching rows: %s", err)
+		return nil, err
+	}
+
+	return t.queryMarbles(stub, append([]string{string(queryStringBytes)}, args[1:]...))
+}
+
+// ============================================================================================================================
+// queryMarbles - rich query using a CouchDB Mango-style selector, e.g.
+// {"selector":{"docType":"Marble","owner":"tom"}}, with optional pageSize/bookmark pagination
+// ============================================================================================================================
+func (t *SimpleChaincode) queryMarbles(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0                1           2
+	// "queryString", "pageSize", "bookmark"  (pageSize and bookmark are optional)
+	if len(args) < 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting queryString")
+	}
+
+	queryString := args[0]
+
+	pageSize, bookmark, err := parsePaginationArgs(args[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	resultsIterator, responseMetadata, err := stub.GetQueryResultWithPagination(queryString, pageSize, bookmark)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var marbles []Marble
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		marble := Marble{}
+		json.Unmarshal(queryResponse.Value, &marble)
+		marbles = append(marbles, marble)
+	}
+
+	fmt.Println("- end queryMarbles")
+	return marshalPaginatedResponse(marbles, responseMetadata)
+}
+
+// ============================================================================================================================
+// Utility functions (may become chaincode APIs)
+// ============================================================================================================================
+
+func (t *SimpleChaincode) createCompoundKey(stub shim.ChaincodeStubInterface, objectType string, keys []string) (string, error) {
+	return stub.CreateCompositeKey(objectType, keys)
+}
+
+// parsePaginationArgs reads an optional pageSize (args[0]) and bookmark (args[1]) off the tail of an
+// invocation's arguments. Both are optional; a zero pageSize tells Fabric to use its own default.
+func parsePaginationArgs(args []string) (int32, string, error) {
+	var pageSize int32
+	var bookmark string
+
+	if len(args) > 0 && args[0] != "" {
+		parsedPageSize, err := strconv.Atoi(args[0])
+		if err != nil {
+			return 0, "", fmt.Errorf("Invalid pageSize: %s", args[0])
+		}
+		pageSize = int32(parsedPageSize)
+	}
+
+	if len(args) > 1 {
+		bookmark = args[1]
+	}
+
+	return pageSize, bookmark, nil
+}
+
+// marshalPaginatedResponse wraps a page of marbles and the query's response metadata into the
+// {records, fetchedRecordsCount, bookmark} envelope returned to clients.
+func marshalPaginatedResponse(marbles []Marble, responseMetadata *pb.QueryResponseMetadata) ([]byte, error) {
+	response := PaginatedQueryResponse{
+		Records:             marbles,
+		FetchedRecordsCount: responseMetadata.FetchedRecordsCount,
+		Bookmark:            responseMetadata.Bookmark,
 	}
-	defer keysIter.Close()
 
-	return keysIter, err
+	return json.Marshal(response)
 }
 
 // ============================================================================================================================
 // Set Owner Permission on Marble
+// Note: set_owner never changes a marble's color, so the color~name index stays valid as-is. If a
+// set_color were ever added, it would need to delete the old color~name index key and write the new one.
 // ============================================================================================================================
 func (t *SimpleChaincode) set_owner(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	var err error
@@ -384,3 +721,129 @@ func (t *SimpleChaincode) set_owner(stub shim.ChaincodeStubInterface, args []str
 	fmt.Println("- end set owner")
 	return nil, nil
 }
+
+// ============================================================================================================================
+// Transfer Marbles By Color - bulk-reassign the owner of every marble of a given color, using the
+// color~name index to find them and rewriting each one inside this single transaction.
+// ============================================================================================================================
+func (t *SimpleChaincode) transfer_marbles_by_color(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0       1
+	// "blue", "jerry"
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting color and newOwner")
+	}
+
+	objectType := "Marble"
+	color := strings.ToLower(args[0])
+	newOwner := strings.ToLower(args[1])
+
+	colorNameIndexIterator, err := stub.GetStateByPartialCompositeKey(colorNameIndex, []string{color})
+	if err != nil {
+		return nil, err
+	}
+	defer colorNameIndexIterator.Close()
+
+	for colorNameIndexIterator.HasNext() {
+		indexEntry, err := colorNameIndexIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		_, compositeKeyParts, err := stub.SplitCompositeKey(indexEntry.Key)
+		if err != nil {
+			return nil, err
+		}
+		name := compositeKeyParts[1]
+
+		compoundKey, _ := t.createCompoundKey(stub, objectType, []string{color, name})
+		marbleJSONBytes, err := stub.GetState(compoundKey)
+		if err != nil {
+			return nil, err
+		}
+		if marbleJSONBytes == nil {
+			return nil, errors.New("color~name index points at a missing marble: " + compoundKey)
+		}
+
+		marble := Marble{}
+		err = json.Unmarshal(marbleJSONBytes, &marble)
+		if err != nil {
+			return nil, err
+		}
+		marble.Owner = newOwner
+
+		updatedMarbleJSONBytes, err := json.Marshal(marble)
+		if err != nil {
+			return nil, err
+		}
+
+		err = stub.PutState(compoundKey, updatedMarbleJSONBytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fmt.Println("- end transfer_marbles_by_color")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Delete Marble - remove a marble and every derived key it has: the public JSON state, the
+// color~name index entry, and, if this marble was ever put into the private collections, the
+// entries there too.
+// ============================================================================================================================
+func (t *SimpleChaincode) delete_marble(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0       1
+	// "name", "blue"
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting name and color")
+	}
+
+	objectType := "Marble"
+	name := args[0]
+	color := strings.ToLower(args[1])
+	compoundKey, _ := t.createCompoundKey(stub, objectType, []string{color, name})
+
+	// A marble may live in public state, the private collections, or both (see init_marble_json vs.
+	// init_marble_private), so existence is checked in public state and in collectionMarbles, which
+	// init_marble_private always writes together with collectionMarblePrivateDetails.
+	marbleJSONBytes, err := stub.GetState(compoundKey)
+	if err != nil {
+		return nil, err
+	}
+	privateMarbleBytes, err := stub.GetPrivateData("collectionMarbles", compoundKey)
+	if err != nil {
+		return nil, err
+	}
+	if marbleJSONBytes == nil && privateMarbleBytes == nil {
+		return nil, errors.New("Marble does not exist: " + compoundKey)
+	}
+
+	err = stub.DelState(compoundKey)
+	if err != nil {
+		return nil, err
+	}
+
+	colorNameIndexKey, err := stub.CreateCompositeKey(colorNameIndex, []string{color, name})
+	if err != nil {
+		return nil, err
+	}
+	err = stub.DelState(colorNameIndexKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// Private collections are optional, so deleting a marble that was never put into them is a no-op
+	err = stub.DelPrivateData("collectionMarbles", compoundKey)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.DelPrivateData("collectionMarblePrivateDetails", compoundKey)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end delete_marble")
+	return nil, nil
+}